@@ -17,8 +17,12 @@ limitations under the License.
 package provider
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/k8s-stackdriver/custom-metrics-stackdriver-adapter/pkg/config"
@@ -30,8 +34,10 @@ import (
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
 )
 
@@ -40,8 +46,20 @@ const (
 	oneOfMax     = 100
 	nodeResource = "nodes"
 	podResource  = "pods"
+
+	// listTimeSeriesWorkers bounds how many batched ListTimeSeries requests
+	// ListTimeSeriesForPods/ListTimeSeriesForNodes issue to Stackdriver concurrently.
+	listTimeSeriesWorkers = 10
+
+	// distributionStatSeparator splits a DISTRIBUTION-backed metric name from the
+	// statistic requested out of it, e.g. "request_latencies|p99".
+	distributionStatSeparator = "|"
 )
 
+// distributionStatSuffixes are the synthetic per-statistic metrics that are
+// derived from a single Stackdriver DISTRIBUTION metric descriptor.
+var distributionStatSuffixes = []string{"p50", "p99", "mean", "count", "sum"}
+
 // Translator is a structure used to translate between Custom Metrics API and Stackdriver API
 type Translator struct {
 	service             *stackdriver.Service
@@ -50,19 +68,235 @@ type Translator struct {
 	clock               clock
 	mapper              apimeta.RESTMapper
 	useNewResourceModel bool
+	// resourceTypeMappings are user-registered ResourceTypeMapping entries, in addition to the
+	// built-in k8s_pod/k8s_node mappings in defaultResourceTypeMappings. See RegisterResourceTypeMapping.
+	resourceTypeMappings []ResourceTypeMapping
+	// aggregationPolicies are admin-supplied MetricAggregationPolicy overrides, keyed by metric
+	// name prefix. See RegisterAggregationPolicy and aggregationPolicyFor.
+	aggregationPolicies []aggregationPolicyOverride
+}
+
+// MetricAggregationPolicy describes how Stackdriver should aggregate the time series backing a
+// metric before a value is returned for it.
+type MetricAggregationPolicy struct {
+	// PerSeriesAligner is the Stackdriver ALIGN_* function applied to each series
+	// individually, e.g. "ALIGN_RATE" for a CUMULATIVE metric or "ALIGN_DELTA" for a DELTA
+	// metric. Required.
+	PerSeriesAligner string
+	// CrossSeriesReducer, if set, is the Stackdriver REDUCE_* function used to combine the
+	// aligned series sharing GroupByFields into one, e.g. "REDUCE_SUM". GroupByFields must
+	// retain the resource's identifying labels (the mapping's NameLabel, and NamespaceLabel if
+	// set) or Stackdriver collapses distinct objects into a single series and per-object
+	// attribution in metricKey breaks; createListTimeseriesRequest rejects a policy that
+	// doesn't.
+	CrossSeriesReducer string
+	// AlignmentPeriod overrides the request window as the period each series is aligned over,
+	// when set.
+	AlignmentPeriod time.Duration
+	// GroupByFields lists the resource/metric label names series are grouped by before
+	// CrossSeriesReducer combines them. Only meaningful when CrossSeriesReducer is set.
+	GroupByFields []string
+}
+
+// defaultAggregationPolicies maps a Stackdriver MetricKind to the MetricAggregationPolicy used
+// for it absent an admin-supplied override: a CUMULATIVE metric (e.g. a request counter) needs
+// ALIGN_RATE to become a rate, a DELTA metric needs ALIGN_DELTA to sum the deltas in the
+// window, and a GAUGE is safe to summarize with ALIGN_MEAN.
+var defaultAggregationPolicies = map[string]MetricAggregationPolicy{
+	"GAUGE":      {PerSeriesAligner: "ALIGN_MEAN"},
+	"DELTA":      {PerSeriesAligner: "ALIGN_DELTA"},
+	"CUMULATIVE": {PerSeriesAligner: "ALIGN_RATE"},
+}
+
+// aggregationPolicyOverride is an admin-supplied MetricAggregationPolicy scoped to metric names
+// starting with prefix, as registered via RegisterAggregationPolicy.
+type aggregationPolicyOverride struct {
+	prefix string
+	policy MetricAggregationPolicy
+}
+
+// RegisterAggregationPolicy adds an admin-supplied MetricAggregationPolicy override for metrics
+// whose name (as exposed to the Custom Metrics API, i.e. without the configured MetricsPrefix,
+// and without any distributionStatSeparator suffix) starts with prefix. Among overrides matching
+// a given metric, the one with the longest prefix wins.
+func (t *Translator) RegisterAggregationPolicy(prefix string, policy MetricAggregationPolicy) {
+	t.aggregationPolicies = append(t.aggregationPolicies, aggregationPolicyOverride{prefix: prefix, policy: policy})
+}
+
+// aggregationPolicyFor resolves the MetricAggregationPolicy to use when querying metricName,
+// given the MetricKind ("GAUGE", "DELTA" or "CUMULATIVE") reported by its Stackdriver
+// descriptor. An admin-supplied override registered via RegisterAggregationPolicy, matched by
+// the longest metric name prefix, takes precedence over the MetricKind default. metricKind may
+// be empty when it isn't known by the caller, in which case the MetricKind defaults are skipped:
+// an override applies if one matches, otherwise ALIGN_DELTA for a distribution metric and
+// ALIGN_NEXT_OLDER for any other.
+func (t *Translator) aggregationPolicyFor(metricKind string, metricName string) MetricAggregationPolicy {
+	descriptorName, _, isDistribution := splitDistributionMetric(metricName)
+	var best *aggregationPolicyOverride
+	for i, override := range t.aggregationPolicies {
+		if !strings.HasPrefix(descriptorName, override.prefix) {
+			continue
+		}
+		if best == nil || len(override.prefix) > len(best.prefix) {
+			best = &t.aggregationPolicies[i]
+		}
+	}
+	if best != nil {
+		return best.policy
+	}
+	if isDistribution {
+		// DISTRIBUTION metrics are always DELTA or CUMULATIVE in Stackdriver, so the last
+		// point can't simply be carried forward like it can for a GAUGE - request the delta
+		// accumulated over the alignment period instead.
+		return MetricAggregationPolicy{PerSeriesAligner: "ALIGN_DELTA"}
+	}
+	if policy, ok := defaultAggregationPolicies[metricKind]; ok {
+		return policy
+	}
+	return MetricAggregationPolicy{PerSeriesAligner: "ALIGN_NEXT_OLDER"}
+}
+
+// ResourceTypeMapping describes how to query Stackdriver for a Kubernetes GroupResource that
+// isn't a pod or a node - e.g. a Service backed by the "k8s_service" monitored resource type, or
+// a CRD backed by a user's own custom monitored resource type. Register one with
+// Translator.RegisterResourceTypeMapping to enable GetSDReqForObjects for that GroupResource.
+type ResourceTypeMapping struct {
+	// GroupResource is the Kubernetes GroupResource this mapping applies to.
+	GroupResource schema.GroupResource
+	// StackdriverResourceType is the Stackdriver monitored resource type backing this
+	// GroupResource, e.g. "k8s_service" or "generic_task".
+	StackdriverResourceType string
+	// NameLabel is the resource.label key on the Stackdriver monitored resource that holds the
+	// Kubernetes object name, e.g. "pod_name" for k8s_pod.
+	NameLabel string
+	// NamespaceLabel is the resource.label key holding the object's namespace. Leave empty for
+	// cluster-scoped resources, mirroring how node metrics carry no namespace label.
+	NamespaceLabel string
+	// MetricLabelKeys, when non-empty, are metric label keys whose presence on a metric
+	// descriptor identifies it as belonging to this GroupResource. Used by
+	// GetMetricsFromSDDescriptorsResp to resolve a GroupResource for descriptors it wouldn't
+	// otherwise recognize.
+	MetricLabelKeys []string
+}
+
+// defaultResourceTypeMappings are the built-in mappings for the two resource types the
+// translator has always supported.
+var defaultResourceTypeMappings = []ResourceTypeMapping{
+	{
+		GroupResource:           schema.GroupResource{Group: "", Resource: podResource},
+		StackdriverResourceType: "k8s_pod",
+		NameLabel:               "pod_name",
+		NamespaceLabel:          "namespace_name",
+	},
+	{
+		GroupResource:           schema.GroupResource{Group: "", Resource: nodeResource},
+		StackdriverResourceType: "k8s_node",
+		NameLabel:               "node_name",
+	},
+}
+
+// RegisterResourceTypeMapping adds a ResourceTypeMapping so that GetSDReqForObjects and
+// GetMetricsFromSDDescriptorsResp know how to handle the GroupResource it describes.
+func (t *Translator) RegisterResourceTypeMapping(mapping ResourceTypeMapping) {
+	t.resourceTypeMappings = append(t.resourceTypeMappings, mapping)
+}
+
+// allResourceTypeMappings returns the built-in pod/node mappings together with any registered
+// via RegisterResourceTypeMapping.
+func (t *Translator) allResourceTypeMappings() []ResourceTypeMapping {
+	return append(append([]ResourceTypeMapping{}, defaultResourceTypeMappings...), t.resourceTypeMappings...)
+}
+
+// resourceTypeMapping looks up the ResourceTypeMapping registered for gr.
+func (t *Translator) resourceTypeMapping(gr schema.GroupResource) (ResourceTypeMapping, bool) {
+	for _, mapping := range t.allResourceTypeMappings() {
+		if mapping.GroupResource == gr {
+			return mapping, true
+		}
+	}
+	return ResourceTypeMapping{}, false
+}
+
+// resourceTypeMappingForStackdriverType looks up the ResourceTypeMapping whose
+// StackdriverResourceType is resourceType.
+func (t *Translator) resourceTypeMappingForStackdriverType(resourceType string) (ResourceTypeMapping, bool) {
+	for _, mapping := range t.allResourceTypeMappings() {
+		if mapping.StackdriverResourceType == resourceType {
+			return mapping, true
+		}
+	}
+	return ResourceTypeMapping{}, false
+}
+
+// filterForObjects builds the per-object portion of a Stackdriver filter for this mapping,
+// analogous to filterForPods/filterForNodes.
+func (m ResourceTypeMapping) filterForObjects(names []string, namespace string) string {
+	nameFilter := fmt.Sprintf("resource.label.%s = %s", m.NameLabel, names[0])
+	if len(names) > 1 {
+		nameFilter = fmt.Sprintf("resource.label.%s = one_of(%s)", m.NameLabel, strings.Join(names, ","))
+	}
+	if m.NamespaceLabel == "" {
+		return nameFilter
+	}
+	return fmt.Sprintf("resource.label.%s = %q AND %s", m.NamespaceLabel, namespace, nameFilter)
+}
+
+// GetSDReqForObjects returns a Stackdriver request for query for multiple objects of an
+// arbitrary Kubernetes GroupResource, provided a ResourceTypeMapping has been registered for it
+// via RegisterResourceTypeMapping. objs is required to be no longer than oneOfMax items, for the
+// same reason as GetSDReqForPods/GetSDReqForNodes. sel, if non-nil, restricts the query to time
+// series whose metric labels satisfy it; see filterForMetricLabels. metricKind is the
+// MetricKind ("GAUGE", "DELTA" or "CUMULATIVE") reported by the metric's Stackdriver descriptor,
+// used to resolve its MetricAggregationPolicy; pass "" if unknown. See aggregationPolicyFor.
+func (t *Translator) GetSDReqForObjects(objs []metav1.ObjectMeta, gr schema.GroupResource, metricName string, namespace string, sel labels.Selector, metricKind string) (*stackdriver.ProjectsTimeSeriesListCall, labels.Selector, error) {
+	if len(objs) == 0 {
+		return nil, nil, apierr.NewBadRequest("No objects matched provided selector")
+	}
+	if len(objs) > oneOfMax {
+		return nil, nil, apierr.NewInternalError(fmt.Errorf("GetSDReqForObjects called with %v objects, but allowed limit is %v", len(objs), oneOfMax))
+	}
+	mapping, ok := t.resourceTypeMapping(gr)
+	if !ok {
+		return nil, nil, apierr.NewBadRequest(fmt.Sprintf("No Stackdriver resource type is registered for %v, call RegisterResourceTypeMapping first", gr))
+	}
+	names := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		names = append(names, fmt.Sprintf("%q", obj.GetName()))
+	}
+	labelFilter, clientSideSel := t.filterForMetricLabels(sel)
+	filter := joinFilters(
+		t.filterForMetric(t.config.MetricsPrefix+"/"+metricName),
+		t.filterForCluster(),
+		mapping.filterForObjects(names, namespace),
+		fmt.Sprintf("resource.type = %q", mapping.StackdriverResourceType))
+	if labelFilter != "" {
+		filter = joinFilters(filter, labelFilter)
+	}
+	call, err := t.createListTimeseriesRequest(filter, metricName, metricKind, mapping)
+	if err != nil {
+		return nil, nil, err
+	}
+	return call, clientSideSel, nil
 }
 
 // GetSDReqForPods returns Stackdriver request for query for multiple pods.
 // podList is required to be no longer than oneOfMax items. This is enforced by limitation of
 // "one_of()" operator in Stackdriver filters, see documentation:
 // https://cloud.google.com/monitoring/api/v3/filters
-func (t *Translator) GetSDReqForPods(podList *v1.PodList, metricName string, namespace string) (*stackdriver.ProjectsTimeSeriesListCall, error) {
+// sel, if non-nil, restricts the query to time series whose metric labels satisfy it. The
+// returned labels.Selector holds any requirements of sel that couldn't be expressed in the
+// Stackdriver filter and must instead be applied client-side; see filterForMetricLabels.
+// metricKind is the MetricKind ("GAUGE", "DELTA" or "CUMULATIVE") reported by the metric's
+// Stackdriver descriptor, used to resolve its MetricAggregationPolicy; pass "" if unknown. See
+// aggregationPolicyFor.
+func (t *Translator) GetSDReqForPods(podList *v1.PodList, metricName string, namespace string, sel labels.Selector, metricKind string) (*stackdriver.ProjectsTimeSeriesListCall, labels.Selector, error) {
 	if len(podList.Items) == 0 {
-		return nil, apierr.NewBadRequest("No objects matched provided selector")
+		return nil, nil, apierr.NewBadRequest("No objects matched provided selector")
 	}
 	if len(podList.Items) > oneOfMax {
-		return nil, apierr.NewInternalError(fmt.Errorf("GetSDReqForPods called with %v pod list, but allowed limit is %v pods", len(podList.Items), oneOfMax))
+		return nil, nil, apierr.NewInternalError(fmt.Errorf("GetSDReqForPods called with %v pod list, but allowed limit is %v pods", len(podList.Items), oneOfMax))
 	}
+	labelFilter, clientSideSel := t.filterForMetricLabels(sel)
 	var filter string
 	if t.useNewResourceModel {
 		resourceNames := getPodNames(podList)
@@ -78,37 +312,190 @@ func (t *Translator) GetSDReqForPods(podList *v1.PodList, metricName string, nam
 			t.legacyFilterForCluster(),
 			t.legacyFilterForPods(resourceIDs))
 	}
-	return t.createListTimeseriesRequest(filter), nil
+	if labelFilter != "" {
+		filter = joinFilters(filter, labelFilter)
+	}
+	mapping, _ := t.resourceTypeMapping(schema.GroupResource{Group: "", Resource: podResource})
+	call, err := t.createListTimeseriesRequest(filter, metricName, metricKind, mapping)
+	if err != nil {
+		return nil, nil, err
+	}
+	return call, clientSideSel, nil
 }
 
 // GetSDReqForNodes returns Stackdriver request for query for multiple nodes.
 // nodeList is required to be no longer than oneOfMax items. This is enforced by limitation of
 // "one_of()" operator in Stackdriver filters, see documentation:
 // https://cloud.google.com/monitoring/api/v3/filters
-func (t *Translator) GetSDReqForNodes(nodeList *v1.NodeList, metricName string) (*stackdriver.ProjectsTimeSeriesListCall, error) {
+// sel, if non-nil, restricts the query to time series whose metric labels satisfy it. The
+// returned labels.Selector holds any requirements of sel that couldn't be expressed in the
+// Stackdriver filter and must instead be applied client-side; see filterForMetricLabels.
+// metricKind is the MetricKind ("GAUGE", "DELTA" or "CUMULATIVE") reported by the metric's
+// Stackdriver descriptor, used to resolve its MetricAggregationPolicy; pass "" if unknown. See
+// aggregationPolicyFor.
+func (t *Translator) GetSDReqForNodes(nodeList *v1.NodeList, metricName string, sel labels.Selector, metricKind string) (*stackdriver.ProjectsTimeSeriesListCall, labels.Selector, error) {
 	if len(nodeList.Items) == 0 {
-		return nil, apierr.NewBadRequest("No objects matched provided selector")
+		return nil, nil, apierr.NewBadRequest("No objects matched provided selector")
 	}
 	if len(nodeList.Items) > oneOfMax {
-		return nil, apierr.NewInternalError(fmt.Errorf("GetSDReqForNodes called with %v node list, but allowed limit is %v nodes", len(nodeList.Items), oneOfMax))
+		return nil, nil, apierr.NewInternalError(fmt.Errorf("GetSDReqForNodes called with %v node list, but allowed limit is %v nodes", len(nodeList.Items), oneOfMax))
 	}
-	var filter string
 	if !t.useNewResourceModel {
-		return nil, provider.NewOperationNotSupportedError("Root scoped metrics are not supported without new Stackdriver resource model enabled")
+		return nil, nil, provider.NewOperationNotSupportedError("Root scoped metrics are not supported without new Stackdriver resource model enabled")
 	}
+	labelFilter, clientSideSel := t.filterForMetricLabels(sel)
 	resourceNames := getNodeNames(nodeList)
-	filter = joinFilters(
+	filter := joinFilters(
 		t.filterForMetric(t.config.MetricsPrefix+"/"+metricName),
 		t.filterForCluster(),
 		t.filterForNodes(resourceNames),
 		t.filterForAnyNode())
-	return t.createListTimeseriesRequest(filter), nil
+	if labelFilter != "" {
+		filter = joinFilters(filter, labelFilter)
+	}
+	mapping, _ := t.resourceTypeMapping(schema.GroupResource{Group: "", Resource: nodeResource})
+	call, err := t.createListTimeseriesRequest(filter, metricName, metricKind, mapping)
+	if err != nil {
+		return nil, nil, err
+	}
+	return call, clientSideSel, nil
+}
+
+// ListTimeSeriesForPods returns metric values for all pods in podList, transparently
+// splitting podList into batches of at most oneOfMax pods, querying Stackdriver for each
+// batch concurrently and merging the results. Unlike GetSDReqForPods, podList may contain
+// more than oneOfMax items. sel, if non-nil, restricts results to series matching it; see
+// GetSDReqForPods. metricKind is forwarded to GetSDReqForPods; pass "" if unknown.
+func (t *Translator) ListTimeSeriesForPods(ctx context.Context, podList *v1.PodList, metricName string, namespace string, sel labels.Selector, metricKind string) (map[string]resource.Quantity, error) {
+	if len(podList.Items) == 0 {
+		return nil, apierr.NewBadRequest("No objects matched provided selector")
+	}
+	groupResource := schema.GroupResource{Group: "", Resource: podResource}
+	requests := make([]func() (*stackdriver.ProjectsTimeSeriesListCall, labels.Selector, error), 0, len(podList.Items)/oneOfMax+1)
+	for _, batch := range batchPods(podList, oneOfMax) {
+		batch := batch
+		requests = append(requests, func() (*stackdriver.ProjectsTimeSeriesListCall, labels.Selector, error) {
+			return t.GetSDReqForPods(batch, metricName, namespace, sel, metricKind)
+		})
+	}
+	return t.listTimeSeriesInBatches(ctx, groupResource, metricName, requests)
+}
+
+// ListTimeSeriesForNodes returns metric values for all nodes in nodeList, transparently
+// splitting nodeList into batches of at most oneOfMax nodes, querying Stackdriver for each
+// batch concurrently and merging the results. Unlike GetSDReqForNodes, nodeList may contain
+// more than oneOfMax items. sel, if non-nil, restricts results to series matching it; see
+// GetSDReqForNodes. metricKind is forwarded to GetSDReqForNodes; pass "" if unknown.
+func (t *Translator) ListTimeSeriesForNodes(ctx context.Context, nodeList *v1.NodeList, metricName string, sel labels.Selector, metricKind string) (map[string]resource.Quantity, error) {
+	if len(nodeList.Items) == 0 {
+		return nil, apierr.NewBadRequest("No objects matched provided selector")
+	}
+	groupResource := schema.GroupResource{Group: "", Resource: nodeResource}
+	requests := make([]func() (*stackdriver.ProjectsTimeSeriesListCall, labels.Selector, error), 0, len(nodeList.Items)/oneOfMax+1)
+	for _, batch := range batchNodes(nodeList, oneOfMax) {
+		batch := batch
+		requests = append(requests, func() (*stackdriver.ProjectsTimeSeriesListCall, labels.Selector, error) {
+			return t.GetSDReqForNodes(batch, metricName, sel, metricKind)
+		})
+	}
+	return t.listTimeSeriesInBatches(ctx, groupResource, metricName, requests)
+}
+
+// listTimeSeriesInBatches executes each of requests under a bounded worker pool, reads one
+// ListTimeSeriesResponse page per request and merges the metric values extracted from all of
+// them into a single map. A batch that matches no time series is treated as empty rather than
+// an error, since other batches are still expected to carry data.
+func (t *Translator) listTimeSeriesInBatches(ctx context.Context, groupResource schema.GroupResource, metricName string, requests []func() (*stackdriver.ProjectsTimeSeriesListCall, labels.Selector, error)) (map[string]resource.Quantity, error) {
+	fetchers := make([]func() (map[string]resource.Quantity, error), len(requests))
+	for i, buildRequest := range requests {
+		buildRequest := buildRequest
+		fetchers[i] = func() (map[string]resource.Quantity, error) {
+			req, clientSideSel, err := buildRequest()
+			if err != nil {
+				return nil, err
+			}
+			resp, err := req.Context(ctx).Do()
+			if err != nil {
+				return nil, apierr.NewInternalError(err)
+			}
+			values, err := t.getMetricValuesFromResponse(groupResource, resp, metricName, clientSideSel)
+			if err != nil && !apierr.IsNotFound(err) {
+				return nil, err
+			}
+			return values, nil
+		}
+	}
+	return mergeBatchResults(fetchers, listTimeSeriesWorkers)
+}
+
+// mergeBatchResults runs each of fetchers under a worker pool bounded to at most maxWorkers
+// concurrent calls, then merges their returned maps into one. Every fetcher is run to completion
+// even if another returns an error, so a single slow or failing batch can't leave the others
+// half-finished; the error of the first failing fetcher in fetchers order is then returned. When
+// two fetchers produce a value for the same key, the one later in fetchers wins.
+func mergeBatchResults(fetchers []func() (map[string]resource.Quantity, error), maxWorkers int) (map[string]resource.Quantity, error) {
+	type batchResult struct {
+		values map[string]resource.Quantity
+		err    error
+	}
+	results := make([]batchResult, len(fetchers))
+	sem := make(chan struct{}, maxWorkers)
+	var wg sync.WaitGroup
+	for i, fetch := range fetchers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, fetch func() (map[string]resource.Quantity, error)) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			values, err := fetch()
+			results[i] = batchResult{values: values, err: err}
+		}(i, fetch)
+	}
+	wg.Wait()
+
+	merged := make(map[string]resource.Quantity)
+	for _, res := range results {
+		if res.err != nil {
+			return nil, res.err
+		}
+		for name, value := range res.values {
+			merged[name] = value
+		}
+	}
+	return merged, nil
+}
+
+// batchPods splits podList into slices of at most batchSize pods each.
+func batchPods(podList *v1.PodList, batchSize int) []*v1.PodList {
+	batches := make([]*v1.PodList, 0, len(podList.Items)/batchSize+1)
+	for start := 0; start < len(podList.Items); start += batchSize {
+		end := start + batchSize
+		if end > len(podList.Items) {
+			end = len(podList.Items)
+		}
+		batches = append(batches, &v1.PodList{Items: podList.Items[start:end]})
+	}
+	return batches
+}
+
+// batchNodes splits nodeList into slices of at most batchSize nodes each.
+func batchNodes(nodeList *v1.NodeList, batchSize int) []*v1.NodeList {
+	batches := make([]*v1.NodeList, 0, len(nodeList.Items)/batchSize+1)
+	for start := 0; start < len(nodeList.Items); start += batchSize {
+		end := start + batchSize
+		if end > len(nodeList.Items) {
+			end = len(nodeList.Items)
+		}
+		batches = append(batches, &v1.NodeList{Items: nodeList.Items[start:end]})
+	}
+	return batches
 }
 
 // GetRespForSingleObject returns translates Stackdriver response to a Custom Metric associated with
-// a single object.
-func (t *Translator) GetRespForSingleObject(response *stackdriver.ListTimeSeriesResponse, groupResource schema.GroupResource, metricName string, namespace string, name string) (*custom_metrics.MetricValue, error) {
-	values, err := t.getMetricValuesFromResponse(groupResource, response, metricName)
+// a single object. sel, if non-nil, is applied client-side to the metric labels of each time
+// series, as returned alongside the request by GetSDReqForPods/GetSDReqForNodes/GetSDReqForObjects.
+func (t *Translator) GetRespForSingleObject(response *stackdriver.ListTimeSeriesResponse, groupResource schema.GroupResource, metricName string, namespace string, name string, sel labels.Selector) (*custom_metrics.MetricValue, error) {
+	values, err := t.getMetricValuesFromResponse(groupResource, response, metricName, sel)
 	if err != nil {
 		return nil, err
 	}
@@ -128,9 +515,10 @@ func (t *Translator) GetRespForSingleObject(response *stackdriver.ListTimeSeries
 }
 
 // GetRespForMultipleObjects translates Stackdriver response to a Custom Metric associated
-// with multiple pods.
-func (t *Translator) GetRespForMultipleObjects(response *stackdriver.ListTimeSeriesResponse, list []metav1.ObjectMeta, groupResource schema.GroupResource, metricName string) ([]custom_metrics.MetricValue, error) {
-	values, err := t.getMetricValuesFromResponse(groupResource, response, metricName)
+// with multiple pods. sel, if non-nil, is applied client-side to the metric labels of each time
+// series, as returned alongside the request by GetSDReqForPods/GetSDReqForNodes/GetSDReqForObjects.
+func (t *Translator) GetRespForMultipleObjects(response *stackdriver.ListTimeSeriesResponse, list []metav1.ObjectMeta, groupResource schema.GroupResource, metricName string, sel labels.Selector) ([]custom_metrics.MetricValue, error) {
+	values, err := t.getMetricValuesFromResponse(groupResource, response, metricName, sel)
 	if err != nil {
 		return nil, err
 	}
@@ -152,25 +540,79 @@ func (t *Translator) ListMetricDescriptors() *stackdriver.ProjectsMetricDescript
 
 // GetMetricsFromSDDescriptorsResp returns an array of MetricInfo for all metric descriptors
 // returned by Stackdriver API that satisfy the requirements:
-// - metricKind is "GAUGE"
-// - valueType is "INT64" or "DOUBLE"
+// - valueType is "INT64" or "DOUBLE", for any metricKind ("GAUGE", "DELTA" or "CUMULATIVE" -
+//   aggregationPolicyFor picks an appropriate aligner for the metricKind at request time), or
+// - valueType is "DISTRIBUTION", in which case one synthetic metric per entry of
+//   distributionStatSuffixes is exposed (e.g. "foo|p99", "foo|mean")
 // - metric name doesn't contain "/" character after "custom.googleapis.com/" prefix
+// The GroupResource reported for each descriptor defaults to the wildcard {"", "*"}, unless a
+// ResourceTypeMapping with matching MetricLabelKeys was registered via
+// RegisterResourceTypeMapping, in which case that mapping's GroupResource is used instead.
 func (t *Translator) GetMetricsFromSDDescriptorsResp(response *stackdriver.ListMetricDescriptorsResponse) []provider.MetricInfo {
 	metrics := []provider.MetricInfo{}
 	for _, descriptor := range response.MetricDescriptors {
-		if descriptor.MetricKind == "GAUGE" &&
-			(descriptor.ValueType == "INT64" || descriptor.ValueType == "DOUBLE") &&
-			!strings.Contains(strings.TrimPrefix(descriptor.Type, t.config.MetricsPrefix+"/"), "/") {
+		name := strings.TrimPrefix(descriptor.Type, t.config.MetricsPrefix+"/")
+		if strings.Contains(name, "/") {
+			continue
+		}
+		groupResource := t.groupResourceForDescriptor(descriptor)
+		switch {
+		case descriptor.ValueType == "INT64" || descriptor.ValueType == "DOUBLE":
 			metrics = append(metrics, provider.MetricInfo{
-				GroupResource: schema.GroupResource{Group: "", Resource: "*"},
-				Metric:        strings.TrimPrefix(descriptor.Type, t.config.MetricsPrefix+"/"),
+				GroupResource: groupResource,
+				Metric:        name,
 				Namespaced:    true,
 			})
+		case descriptor.ValueType == "DISTRIBUTION":
+			for _, stat := range distributionStatSuffixes {
+				metrics = append(metrics, provider.MetricInfo{
+					GroupResource: groupResource,
+					Metric:        name + distributionStatSeparator + stat,
+					Namespaced:    true,
+				})
+			}
 		}
 	}
 	return metrics
 }
 
+// groupResourceForDescriptor resolves the GroupResource to report for descriptor, by finding a
+// registered ResourceTypeMapping whose MetricLabelKeys are all present among the descriptor's
+// metric labels. Falls back to the wildcard {"", "*"} used historically when no mapping matches.
+func (t *Translator) groupResourceForDescriptor(descriptor *stackdriver.MetricDescriptor) schema.GroupResource {
+	labelKeys := make(map[string]bool, len(descriptor.Labels))
+	for _, label := range descriptor.Labels {
+		labelKeys[label.Key] = true
+	}
+	for _, mapping := range t.resourceTypeMappings {
+		if len(mapping.MetricLabelKeys) == 0 {
+			continue
+		}
+		matchesAll := true
+		for _, key := range mapping.MetricLabelKeys {
+			if !labelKeys[key] {
+				matchesAll = false
+				break
+			}
+		}
+		if matchesAll {
+			return mapping.GroupResource
+		}
+	}
+	return schema.GroupResource{Group: "", Resource: "*"}
+}
+
+// splitDistributionMetric splits a metric name into the underlying Stackdriver
+// descriptor name and the requested statistic, e.g. "foo|p99" -> ("foo", "p99", true).
+// Metric names without a distributionStatSeparator are returned unchanged with ok set to false.
+func splitDistributionMetric(metricName string) (descriptorName string, stat string, ok bool) {
+	idx := strings.LastIndex(metricName, distributionStatSeparator)
+	if idx < 0 {
+		return metricName, "", false
+	}
+	return metricName[:idx], metricName[idx+1:], true
+}
+
 func getPodNames(list *v1.PodList) []string {
 	resourceNames := []string{}
 	for _, item := range list.Items {
@@ -211,7 +653,8 @@ func (t *Translator) filterForMetricPrefix() string {
 }
 
 func (t *Translator) filterForMetric(metricName string) string {
-	return fmt.Sprintf("metric.type = %q", metricName)
+	descriptorName, _, _ := splitDistributionMetric(metricName)
+	return fmt.Sprintf("metric.type = %q", descriptorName)
 }
 
 func (t *Translator) filterForAnyPod() string {
@@ -223,7 +666,12 @@ func (t *Translator) filterForAnyNode() string {
 }
 
 func (t *Translator) filterForAnyResource() string {
-	return "resource.type = one_of(\"k8s_pod\",\"k8s_node\")"
+	mappings := t.allResourceTypeMappings()
+	resourceTypes := make([]string, 0, len(mappings))
+	for _, mapping := range mappings {
+		resourceTypes = append(resourceTypes, fmt.Sprintf("%q", mapping.StackdriverResourceType))
+	}
+	return fmt.Sprintf("resource.type = one_of(%s)", strings.Join(resourceTypes, ","))
 }
 
 func (t *Translator) filterForPods(podNames []string, namespace string) string {
@@ -244,6 +692,49 @@ func (t *Translator) filterForNodes(nodeNames []string) string {
 	return fmt.Sprintf("resource.label.node_name = one_of(%s)", strings.Join(nodeNames, ","))
 }
 
+// filterForMetricLabels translates the equality and set-based requirements of sel into a
+// Stackdriver filter clause of the form "metric.label.<key> = <value>" /
+// "metric.label.<key> = one_of(...)", AND-joined. Requirements that Cloud Monitoring's filter
+// grammar can't express (e.g. "!=", or anything requiring an OR across labels) are left out of
+// the returned filter and instead returned as a labels.Selector of their own, to be applied
+// client-side by getMetricValuesFromResponse. Returns ("", nil) if sel is nil or matches
+// everything.
+func (t *Translator) filterForMetricLabels(sel labels.Selector) (string, labels.Selector) {
+	if sel == nil || sel.Empty() {
+		return "", nil
+	}
+	requirements, selectable := sel.Requirements()
+	if !selectable {
+		return "", sel
+	}
+	var sdFilters []string
+	var clientSideReqs labels.Requirements
+	for _, req := range requirements {
+		switch req.Operator() {
+		case selection.Equals, selection.DoubleEquals:
+			values := req.Values().List()
+			sdFilters = append(sdFilters, fmt.Sprintf("metric.label.%s = %q", req.Key(), values[0]))
+		case selection.In:
+			values := req.Values().List()
+			quoted := make([]string, 0, len(values))
+			for _, value := range values {
+				quoted = append(quoted, fmt.Sprintf("%q", value))
+			}
+			sdFilters = append(sdFilters, fmt.Sprintf("metric.label.%s = one_of(%s)", req.Key(), strings.Join(quoted, ",")))
+		default:
+			// NotEquals, NotIn, Exists, DoesNotExist and ordering requirements have no
+			// equivalent in the Stackdriver filter grammar - keep them for client-side
+			// filtering instead of silently dropping them.
+			clientSideReqs = append(clientSideReqs, req)
+		}
+	}
+	var clientSideSel labels.Selector
+	if len(clientSideReqs) > 0 {
+		clientSideSel = labels.NewSelector().Add(clientSideReqs...)
+	}
+	return joinFilters(sdFilters...), clientSideSel
+}
+
 func (t *Translator) legacyFilterForCluster() string {
 	projectFilter := fmt.Sprintf("resource.label.project_id = %q", t.config.Project)
 	// Skip location, since it may be set incorrectly by Heapster for old resource model
@@ -265,26 +756,81 @@ func (t *Translator) legacyFilterForPods(podIDs []string) string {
 	return fmt.Sprintf("resource.label.pod_id = one_of(%s)", strings.Join(podIDs, ","))
 }
 
-func (t *Translator) createListTimeseriesRequest(filter string) *stackdriver.ProjectsTimeSeriesListCall {
+// createListTimeseriesRequest builds the ListTimeSeries call for filter/metricName, aggregating
+// per aggregationPolicyFor's resolution of metricKind and metricName. metricKind may be "" if
+// the caller doesn't know it, in which case the MetricKind defaults are skipped (see
+// aggregationPolicyFor). mapping
+// is the ResourceTypeMapping of the objects being queried for, used to validate that a
+// CrossSeriesReducer policy doesn't drop the resource labels metricKey needs to attribute a
+// reduced value back to an individual object; see requireIdentifyingGroupByFields.
+func (t *Translator) createListTimeseriesRequest(filter string, metricName string, metricKind string, mapping ResourceTypeMapping) (*stackdriver.ProjectsTimeSeriesListCall, error) {
+	policy := t.aggregationPolicyFor(metricKind, metricName)
+	if policy.CrossSeriesReducer != "" {
+		if err := requireIdentifyingGroupByFields(policy, mapping); err != nil {
+			return nil, err
+		}
+	}
 	project := fmt.Sprintf("projects/%s", t.config.Project)
 	endTime := t.clock.Now()
 	startTime := endTime.Add(-t.reqWindow)
-	return t.service.Projects.TimeSeries.List(project).Filter(filter).
+	alignmentPeriod := t.reqWindow
+	if policy.AlignmentPeriod > 0 {
+		alignmentPeriod = policy.AlignmentPeriod
+	}
+	call := t.service.Projects.TimeSeries.List(project).Filter(filter).
 		IntervalStartTime(startTime.Format(time.RFC3339)).
 		IntervalEndTime(endTime.Format(time.RFC3339)).
-		AggregationPerSeriesAligner("ALIGN_NEXT_OLDER").
-		AggregationAlignmentPeriod(fmt.Sprintf("%vs", int64(t.reqWindow.Seconds())))
+		AggregationPerSeriesAligner(policy.PerSeriesAligner).
+		AggregationAlignmentPeriod(fmt.Sprintf("%vs", int64(alignmentPeriod.Seconds())))
+	if policy.CrossSeriesReducer != "" {
+		call = call.AggregationCrossSeriesReducer(policy.CrossSeriesReducer)
+	}
+	if len(policy.GroupByFields) > 0 {
+		call = call.AggregationGroupByFields(policy.GroupByFields...)
+	}
+	return call, nil
 }
 
-func (t *Translator) getMetricValuesFromResponse(groupResource schema.GroupResource, response *stackdriver.ListTimeSeriesResponse, metricName string) (map[string]resource.Quantity, error) {
+// requireIdentifyingGroupByFields rejects a CrossSeriesReducer policy whose GroupByFields would
+// let Stackdriver collapse multiple objects of mapping's GroupResource into one series:
+// GetSDReqForPods/GetSDReqForNodes/GetSDReqForObjects query for many objects per batch and rely
+// on metricKey reading the resource labels named by mapping.NameLabel/NamespaceLabel out of each
+// returned series to attribute its value back to an individual object, so a reducer must be
+// grouped by those labels to keep that attribution intact.
+func requireIdentifyingGroupByFields(policy MetricAggregationPolicy, mapping ResourceTypeMapping) error {
+	required := []string{mapping.NameLabel}
+	if mapping.NamespaceLabel != "" {
+		required = append(required, mapping.NamespaceLabel)
+	}
+	for _, label := range required {
+		field := fmt.Sprintf("resource.label.%s", label)
+		found := false
+		for _, groupByField := range policy.GroupByFields {
+			if groupByField == field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return apierr.NewBadRequest(fmt.Sprintf("MetricAggregationPolicy.CrossSeriesReducer is set but GroupByFields doesn't include %q, so Stackdriver would collapse distinct %s objects into one series", field, mapping.GroupResource.Resource))
+		}
+	}
+	return nil
+}
+
+func (t *Translator) getMetricValuesFromResponse(groupResource schema.GroupResource, response *stackdriver.ListTimeSeriesResponse, metricName string, sel labels.Selector) (map[string]resource.Quantity, error) {
 	if len(response.TimeSeries) < 1 {
 		return nil, provider.NewMetricNotFoundError(groupResource, metricName)
 	}
+	_, stat, isDistribution := splitDistributionMetric(metricName)
 	metricValues := make(map[string]resource.Quantity)
 	// Find time series with specified labels matching
 	// Stackdriver API doesn't allow complex label filtering (i.e. "label1 = x AND (label2 = y OR label2 = z)"),
 	// therefore only part of the filters is passed and remaining filtering is done here.
 	for _, series := range response.TimeSeries {
+		if sel != nil && !sel.Matches(labels.Set(series.Metric.Labels)) {
+			continue
+		}
 		if len(series.Points) != 1 {
 			// This shouldn't happen with correct query to Stackdriver
 			return nil, apierr.NewInternalError(fmt.Errorf("Expected exactly one Point in TimeSeries from Stackdriver, but received %v", len(series.Points)))
@@ -307,13 +853,111 @@ func (t *Translator) getMetricValuesFromResponse(groupResource schema.GroupResou
 		case value.DoubleValue != nil:
 			currentQuantity.Add(*resource.NewMilliQuantity(int64(*value.DoubleValue*1000), resource.DecimalSI))
 			metricValues[name] = currentQuantity
+		case value.DistributionValue != nil:
+			if !isDistribution {
+				return nil, apierr.NewBadRequest(fmt.Sprintf("Received a DistributionValue for metric %q, which doesn't request a distribution statistic (e.g. %q)", metricName, metricName+distributionStatSeparator+"p99"))
+			}
+			statValue, err := distributionStat(value.DistributionValue, stat)
+			if err != nil {
+				return nil, err
+			}
+			currentQuantity.Add(*resource.NewMilliQuantity(int64(statValue*1000), resource.DecimalSI))
+			metricValues[name] = currentQuantity
 		default:
-			return nil, apierr.NewBadRequest(fmt.Sprintf("Expected metric of type DoubleValue or Int64Value, but received TypedValue: %v", value))
+			return nil, apierr.NewBadRequest(fmt.Sprintf("Expected metric of type DoubleValue, Int64Value or DistributionValue, but received TypedValue: %v", value))
 		}
 	}
 	return metricValues, nil
 }
 
+// distributionStat computes the requested statistic (a percentile like "p99", or
+// "mean"/"count"/"sum") out of a single Stackdriver Distribution point.
+func distributionStat(dist *stackdriver.Distribution, stat string) (float64, error) {
+	switch {
+	case stat == "mean":
+		return dist.Mean, nil
+	case stat == "count":
+		return float64(dist.Count), nil
+	case stat == "sum":
+		return dist.Mean * float64(dist.Count), nil
+	case strings.HasPrefix(stat, "p"):
+		percentile, err := strconv.ParseFloat(strings.TrimPrefix(stat, "p"), 64)
+		if err != nil {
+			return 0, apierr.NewBadRequest(fmt.Sprintf("Invalid percentile suffix %q in distribution metric name", stat))
+		}
+		return distributionPercentile(dist, percentile/100)
+	default:
+		return 0, apierr.NewBadRequest(fmt.Sprintf("Unsupported distribution metric suffix %q", stat))
+	}
+}
+
+// distributionPercentile walks the bucket counts of a Distribution, in bucket order,
+// and returns the upper bound of the bucket in which the given percentile (in [0, 1])
+// falls.
+//
+// Per the Stackdriver Distribution bucket semantics, BucketCounts[0] is the underflow
+// bucket (values below bounds[0]), BucketCounts[i] for 0 < i < len(bounds) covers
+// [bounds[i-1], bounds[i]), and BucketCounts[len(bounds)] is the overflow bucket (values
+// at or above bounds[len(bounds)-1]).
+func distributionPercentile(dist *stackdriver.Distribution, percentile float64) (float64, error) {
+	if dist.Count == 0 {
+		return 0, nil
+	}
+	bounds, err := distributionBucketBounds(dist.BucketOptions)
+	if err != nil {
+		return 0, err
+	}
+	target := float64(dist.Count) * percentile
+	var cumulative int64
+	for i, count := range dist.BucketCounts {
+		cumulative += count
+		if float64(cumulative) < target {
+			continue
+		}
+		switch {
+		case i == 0:
+			// Underflow bucket: clip to the first finite bound.
+			return bounds[0], nil
+		case i >= len(bounds):
+			// Overflow bucket: clip to the last finite bound.
+			return bounds[len(bounds)-1], nil
+		default:
+			// Bucket i covers [bounds[i-1], bounds[i]) - its upper bound is bounds[i].
+			return bounds[i], nil
+		}
+	}
+	return bounds[len(bounds)-1], nil
+}
+
+// distributionBucketBounds returns bounds in the same convention Stackdriver uses for
+// Distribution.BucketOptions.Explicit.Bounds: bounds[0] is the underflow/bucket-1 edge,
+// and bucket i (0 < i < len(bounds)) covers [bounds[i-1], bounds[i]), regardless of which
+// bucketing scheme was used to define the buckets.
+func distributionBucketBounds(opts *stackdriver.BucketOptions) ([]float64, error) {
+	switch {
+	case opts == nil:
+		return nil, apierr.NewInternalError(fmt.Errorf("Distribution value is missing BucketOptions"))
+	case opts.ExplicitBuckets != nil:
+		return opts.ExplicitBuckets.Bounds, nil
+	case opts.LinearBuckets != nil:
+		linear := opts.LinearBuckets
+		bounds := make([]float64, 0, linear.NumFiniteBuckets+1)
+		for i := int64(0); i <= linear.NumFiniteBuckets; i++ {
+			bounds = append(bounds, linear.Offset+linear.Width*float64(i))
+		}
+		return bounds, nil
+	case opts.ExponentialBuckets != nil:
+		exponential := opts.ExponentialBuckets
+		bounds := make([]float64, 0, exponential.NumFiniteBuckets+1)
+		for i := int64(0); i <= exponential.NumFiniteBuckets; i++ {
+			bounds = append(bounds, exponential.Scale*math.Pow(exponential.GrowthFactor, float64(i)))
+		}
+		return bounds, nil
+	default:
+		return nil, apierr.NewInternalError(fmt.Errorf("Distribution BucketOptions has no recognized bucketing scheme"))
+	}
+}
+
 func (t *Translator) metricFor(value resource.Quantity, groupResource schema.GroupResource, namespace string, name string, metricName string) (*custom_metrics.MetricValue, error) {
 	kind, err := t.mapper.KindFor(groupResource.WithVersion(""))
 	if err != nil {
@@ -376,11 +1020,12 @@ func (t *Translator) resourceKey(object metav1.ObjectMeta) string {
 
 func (t *Translator) metricKey(timeSeries *stackdriver.TimeSeries) (string, error) {
 	if t.useNewResourceModel {
-		switch timeSeries.Resource.Type {
-		case "k8s_pod":
-			return timeSeries.Resource.Labels["namespace_name"] + ":" + timeSeries.Resource.Labels["pod_name"], nil
-		case "k8s_node":
-			return ":" + timeSeries.Resource.Labels["node_name"], nil
+		if mapping, ok := t.resourceTypeMappingForStackdriverType(timeSeries.Resource.Type); ok {
+			name := timeSeries.Resource.Labels[mapping.NameLabel]
+			if mapping.NamespaceLabel == "" {
+				return ":" + name, nil
+			}
+			return timeSeries.Resource.Labels[mapping.NamespaceLabel] + ":" + name, nil
 		}
 	} else {
 		return timeSeries.Resource.Labels["pod_id"], nil
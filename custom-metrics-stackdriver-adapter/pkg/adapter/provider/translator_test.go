@@ -0,0 +1,646 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	stackdriver "google.golang.org/api/monitoring/v3"
+	"k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+func TestDistributionBucketBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *stackdriver.BucketOptions
+		want    []float64
+		wantErr bool
+	}{
+		{
+			name: "explicit",
+			opts: &stackdriver.BucketOptions{
+				ExplicitBuckets: &stackdriver.Explicit{Bounds: []float64{10, 20, 30, 40}},
+			},
+			want: []float64{10, 20, 30, 40},
+		},
+		{
+			name: "linear",
+			opts: &stackdriver.BucketOptions{
+				LinearBuckets: &stackdriver.Linear{NumFiniteBuckets: 3, Width: 5, Offset: 10},
+			},
+			want: []float64{10, 15, 20, 25},
+		},
+		{
+			name: "exponential",
+			opts: &stackdriver.BucketOptions{
+				ExponentialBuckets: &stackdriver.Exponential{NumFiniteBuckets: 3, GrowthFactor: 2, Scale: 1},
+			},
+			want: []float64{1, 2, 4, 8},
+		},
+		{
+			name:    "missing bucket options",
+			opts:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "no recognized scheme",
+			opts:    &stackdriver.BucketOptions{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := distributionBucketBounds(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("distributionBucketBounds() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("distributionBucketBounds() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("distributionBucketBounds()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDistributionPercentile(t *testing.T) {
+	// bounds = [10, 20, 30, 40]: bucket 0 is the underflow bucket (<10), bucket i for
+	// 0 < i < 4 covers [bounds[i-1], bounds[i]), and bucket 4 is the overflow bucket (>=40).
+	bounds := &stackdriver.BucketOptions{
+		ExplicitBuckets: &stackdriver.Explicit{Bounds: []float64{10, 20, 30, 40}},
+	}
+	tests := []struct {
+		name         string
+		bucketCounts []int64
+		percentile   float64
+		want         float64
+	}{
+		{
+			name:         "empty distribution",
+			bucketCounts: []int64{0, 0, 0, 0, 0},
+			percentile:   0.5,
+			want:         0,
+		},
+		{
+			name: "interior bucket returns its upper bound",
+			// 100 samples in [20, 30).
+			bucketCounts: []int64{0, 0, 100, 0, 0},
+			percentile:   0.5,
+			want:         30,
+		},
+		{
+			name: "underflow bucket clips to the first bound",
+			bucketCounts: []int64{100, 0, 0, 0, 0},
+			percentile:   0.5,
+			want:         10,
+		},
+		{
+			name: "overflow bucket clips to the last bound",
+			bucketCounts: []int64{0, 0, 0, 0, 100},
+			percentile:   0.99,
+			want:         40,
+		},
+		{
+			name: "percentile resolved after accumulating multiple buckets",
+			bucketCounts: []int64{0, 60, 40, 0, 0},
+			percentile:   0.5,
+			want:         20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count int64
+			for _, c := range tt.bucketCounts {
+				count += c
+			}
+			dist := &stackdriver.Distribution{Count: count, BucketCounts: tt.bucketCounts, BucketOptions: bounds}
+			got, err := distributionPercentile(dist, tt.percentile)
+			if err != nil {
+				t.Fatalf("distributionPercentile() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("distributionPercentile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistributionPercentileLinearAndExponentialBuckets(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         *stackdriver.BucketOptions
+		bucketCounts []int64
+		percentile   float64
+		want         float64
+	}{
+		{
+			// bounds = [10, 15, 20, 25]: bucket 1 is [10, 15).
+			name: "linear bucket returns its upper bound",
+			opts: &stackdriver.BucketOptions{
+				LinearBuckets: &stackdriver.Linear{NumFiniteBuckets: 3, Width: 5, Offset: 10},
+			},
+			bucketCounts: []int64{0, 100, 0, 0, 0},
+			percentile:   0.5,
+			want:         15,
+		},
+		{
+			// bounds = [1, 2, 4, 8]: bucket 1 is [1, 2).
+			name: "exponential bucket returns its upper bound",
+			opts: &stackdriver.BucketOptions{
+				ExponentialBuckets: &stackdriver.Exponential{NumFiniteBuckets: 3, GrowthFactor: 2, Scale: 1},
+			},
+			bucketCounts: []int64{0, 100, 0, 0, 0},
+			percentile:   0.5,
+			want:         2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count int64
+			for _, c := range tt.bucketCounts {
+				count += c
+			}
+			dist := &stackdriver.Distribution{Count: count, BucketCounts: tt.bucketCounts, BucketOptions: tt.opts}
+			got, err := distributionPercentile(dist, tt.percentile)
+			if err != nil {
+				t.Fatalf("distributionPercentile() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("distributionPercentile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistributionStat(t *testing.T) {
+	dist := &stackdriver.Distribution{
+		Count: 100,
+		Mean:  5,
+		BucketCounts: []int64{0, 100, 0},
+		BucketOptions: &stackdriver.BucketOptions{
+			ExplicitBuckets: &stackdriver.Explicit{Bounds: []float64{10, 20}},
+		},
+	}
+	tests := []struct {
+		stat    string
+		want    float64
+		wantErr bool
+	}{
+		{stat: "mean", want: 5},
+		{stat: "count", want: 100},
+		{stat: "sum", want: 500},
+		{stat: "p50", want: 20},
+		{stat: "pbogus", wantErr: true},
+		{stat: "unsupported", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.stat, func(t *testing.T) {
+			got, err := distributionStat(dist, tt.stat)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("distributionStat(%q) error = %v, wantErr %v", tt.stat, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("distributionStat(%q) = %v, want %v", tt.stat, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterForMetricLabels(t *testing.T) {
+	tr := &Translator{}
+
+	t.Run("nil selector", func(t *testing.T) {
+		filter, clientSide := tr.filterForMetricLabels(nil)
+		if filter != "" || clientSide != nil {
+			t.Errorf("filterForMetricLabels(nil) = (%q, %v), want (\"\", nil)", filter, clientSide)
+		}
+	})
+
+	t.Run("everything selector", func(t *testing.T) {
+		filter, clientSide := tr.filterForMetricLabels(labels.Everything())
+		if filter != "" || clientSide != nil {
+			t.Errorf("filterForMetricLabels(Everything()) = (%q, %v), want (\"\", nil)", filter, clientSide)
+		}
+	})
+
+	t.Run("equality requirement becomes a Stackdriver filter clause", func(t *testing.T) {
+		sel := labels.SelectorFromSet(labels.Set{"verb": "GET"})
+		filter, clientSide := tr.filterForMetricLabels(sel)
+		want := `metric.label.verb = "GET"`
+		if filter != want {
+			t.Errorf("filterForMetricLabels() filter = %q, want %q", filter, want)
+		}
+		if clientSide != nil {
+			t.Errorf("filterForMetricLabels() clientSide = %v, want nil", clientSide)
+		}
+	})
+
+	t.Run("in requirement becomes a one_of clause", func(t *testing.T) {
+		req, err := labels.NewRequirement("code", selection.In, []string{"200", "201"})
+		if err != nil {
+			t.Fatalf("NewRequirement() error = %v", err)
+		}
+		sel := labels.NewSelector().Add(*req)
+		filter, clientSide := tr.filterForMetricLabels(sel)
+		want := `metric.label.code = one_of("200","201")`
+		if filter != want {
+			t.Errorf("filterForMetricLabels() filter = %q, want %q", filter, want)
+		}
+		if clientSide != nil {
+			t.Errorf("filterForMetricLabels() clientSide = %v, want nil", clientSide)
+		}
+	})
+
+	t.Run("not-expressible requirement is kept for client-side filtering", func(t *testing.T) {
+		req, err := labels.NewRequirement("code", selection.NotEquals, []string{"500"})
+		if err != nil {
+			t.Fatalf("NewRequirement() error = %v", err)
+		}
+		sel := labels.NewSelector().Add(*req)
+		filter, clientSide := tr.filterForMetricLabels(sel)
+		if filter != "" {
+			t.Errorf("filterForMetricLabels() filter = %q, want \"\"", filter)
+		}
+		if clientSide == nil || !clientSide.Matches(labels.Set{"code": "200"}) || clientSide.Matches(labels.Set{"code": "500"}) {
+			t.Errorf("filterForMetricLabels() clientSide = %v, want a selector rejecting code=500", clientSide)
+		}
+	})
+
+	t.Run("mixed requirements split between filter and client-side selector", func(t *testing.T) {
+		equalsReq, err := labels.NewRequirement("verb", selection.Equals, []string{"GET"})
+		if err != nil {
+			t.Fatalf("NewRequirement() error = %v", err)
+		}
+		notEqualsReq, err := labels.NewRequirement("code", selection.NotEquals, []string{"500"})
+		if err != nil {
+			t.Fatalf("NewRequirement() error = %v", err)
+		}
+		sel := labels.NewSelector().Add(*equalsReq, *notEqualsReq)
+		filter, clientSide := tr.filterForMetricLabels(sel)
+		want := `metric.label.verb = "GET"`
+		if filter != want {
+			t.Errorf("filterForMetricLabels() filter = %q, want %q", filter, want)
+		}
+		if clientSide == nil || clientSide.Matches(labels.Set{"code": "500"}) {
+			t.Errorf("filterForMetricLabels() clientSide = %v, want a selector rejecting code=500", clientSide)
+		}
+	})
+}
+
+func TestAggregationPolicyFor(t *testing.T) {
+	t.Run("defaults by MetricKind", func(t *testing.T) {
+		tr := &Translator{}
+		cases := map[string]string{
+			"GAUGE":      "ALIGN_MEAN",
+			"DELTA":      "ALIGN_DELTA",
+			"CUMULATIVE": "ALIGN_RATE",
+		}
+		for kind, wantAligner := range cases {
+			if got := tr.aggregationPolicyFor(kind, "some/metric").PerSeriesAligner; got != wantAligner {
+				t.Errorf("aggregationPolicyFor(%q, ...) = %q, want %q", kind, got, wantAligner)
+			}
+		}
+	})
+
+	t.Run("unknown MetricKind falls back to ALIGN_NEXT_OLDER", func(t *testing.T) {
+		tr := &Translator{}
+		if got := tr.aggregationPolicyFor("", "some/metric").PerSeriesAligner; got != "ALIGN_NEXT_OLDER" {
+			t.Errorf("aggregationPolicyFor(\"\", ...) = %q, want ALIGN_NEXT_OLDER", got)
+		}
+	})
+
+	t.Run("distribution metrics always align with ALIGN_DELTA", func(t *testing.T) {
+		tr := &Translator{}
+		if got := tr.aggregationPolicyFor("GAUGE", "request_latencies|p99").PerSeriesAligner; got != "ALIGN_DELTA" {
+			t.Errorf("aggregationPolicyFor(GAUGE, distribution metric) = %q, want ALIGN_DELTA", got)
+		}
+	})
+
+	t.Run("longest matching prefix override wins", func(t *testing.T) {
+		tr := &Translator{}
+		tr.RegisterAggregationPolicy("foo", MetricAggregationPolicy{PerSeriesAligner: "ALIGN_SUM"})
+		tr.RegisterAggregationPolicy("foo/bar", MetricAggregationPolicy{PerSeriesAligner: "ALIGN_MAX", CrossSeriesReducer: "REDUCE_MAX"})
+		got := tr.aggregationPolicyFor("GAUGE", "foo/bar/baz")
+		if got.PerSeriesAligner != "ALIGN_MAX" || got.CrossSeriesReducer != "REDUCE_MAX" {
+			t.Errorf("aggregationPolicyFor() = %+v, want the foo/bar override", got)
+		}
+	})
+}
+
+func TestRequireIdentifyingGroupByFields(t *testing.T) {
+	podMapping := defaultResourceTypeMappings[0]  // k8s_pod: NameLabel "pod_name", NamespaceLabel "namespace_name"
+	nodeMapping := defaultResourceTypeMappings[1] // k8s_node: NameLabel "node_name", no NamespaceLabel
+
+	tests := []struct {
+		name    string
+		policy  MetricAggregationPolicy
+		mapping ResourceTypeMapping
+		wantErr bool
+	}{
+		{
+			name:    "no GroupByFields at all",
+			policy:  MetricAggregationPolicy{CrossSeriesReducer: "REDUCE_SUM"},
+			mapping: podMapping,
+			wantErr: true,
+		},
+		{
+			name:    "GroupByFields missing the namespace label",
+			policy:  MetricAggregationPolicy{CrossSeriesReducer: "REDUCE_SUM", GroupByFields: []string{"resource.label.pod_name"}},
+			mapping: podMapping,
+			wantErr: true,
+		},
+		{
+			name:    "GroupByFields retains both identifying labels",
+			policy:  MetricAggregationPolicy{CrossSeriesReducer: "REDUCE_SUM", GroupByFields: []string{"resource.label.pod_name", "resource.label.namespace_name"}},
+			mapping: podMapping,
+			wantErr: false,
+		},
+		{
+			name:    "cluster-scoped mapping only requires the name label",
+			policy:  MetricAggregationPolicy{CrossSeriesReducer: "REDUCE_SUM", GroupByFields: []string{"resource.label.node_name"}},
+			mapping: nodeMapping,
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := requireIdentifyingGroupByFields(tt.policy, tt.mapping)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("requireIdentifyingGroupByFields() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCreateListTimeseriesRequestRejectsUnsafeCrossSeriesReducer exercises the choke point shared
+// by GetSDReqForPods/GetSDReqForNodes/GetSDReqForObjects: a CrossSeriesReducer policy that would
+// collapse distinct objects into one series must be rejected before a request is ever built.
+func TestCreateListTimeseriesRequestRejectsUnsafeCrossSeriesReducer(t *testing.T) {
+	tr := &Translator{}
+	tr.RegisterAggregationPolicy("request_latencies", MetricAggregationPolicy{
+		PerSeriesAligner:   "ALIGN_MEAN",
+		CrossSeriesReducer: "REDUCE_MEAN",
+		// Missing "resource.label.pod_name"/"resource.label.namespace_name" - should be rejected.
+	})
+	podMapping := defaultResourceTypeMappings[0]
+	_, err := tr.createListTimeseriesRequest("irrelevant filter", "request_latencies", "GAUGE", podMapping)
+	if err == nil {
+		t.Fatal("createListTimeseriesRequest() error = nil, want an error rejecting the unsafe CrossSeriesReducer policy")
+	}
+}
+
+func TestBatchPods(t *testing.T) {
+	podList := &v1.PodList{Items: make([]v1.Pod, 5)}
+	batches := batchPods(podList, 2)
+	if len(batches) != 3 {
+		t.Fatalf("batchPods() returned %d batches, want 3", len(batches))
+	}
+	wantSizes := []int{2, 2, 1}
+	for i, batch := range batches {
+		if len(batch.Items) != wantSizes[i] {
+			t.Errorf("batches[%d] has %d items, want %d", i, len(batch.Items), wantSizes[i])
+		}
+	}
+}
+
+func TestBatchNodes(t *testing.T) {
+	nodeList := &v1.NodeList{Items: make([]v1.Node, 5)}
+	batches := batchNodes(nodeList, 2)
+	if len(batches) != 3 {
+		t.Fatalf("batchNodes() returned %d batches, want 3", len(batches))
+	}
+	wantSizes := []int{2, 2, 1}
+	for i, batch := range batches {
+		if len(batch.Items) != wantSizes[i] {
+			t.Errorf("batches[%d] has %d items, want %d", i, len(batch.Items), wantSizes[i])
+		}
+	}
+}
+
+// fakeBatchFetcher returns values (or err, if non-nil) after recording its own concurrent
+// execution in inFlight/maxInFlight, for use with mergeBatchResults.
+func fakeBatchFetcher(values map[string]resource.Quantity, err error, inFlight, maxInFlight *int32, release <-chan struct{}) func() (map[string]resource.Quantity, error) {
+	return func() (map[string]resource.Quantity, error) {
+		n := atomic.AddInt32(inFlight, 1)
+		for {
+			max := atomic.LoadInt32(maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(maxInFlight, max, n) {
+				break
+			}
+		}
+		if release != nil {
+			<-release
+		}
+		atomic.AddInt32(inFlight, -1)
+		return values, err
+	}
+}
+
+func TestMergeBatchResultsBoundsConcurrency(t *testing.T) {
+	const maxWorkers = 2
+	const numFetchers = 5
+	var inFlight, maxInFlight int32
+	release := make(chan struct{})
+	fetchers := make([]func() (map[string]resource.Quantity, error), numFetchers)
+	for i := range fetchers {
+		fetchers[i] = fakeBatchFetcher(nil, nil, &inFlight, &maxInFlight, release)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	if _, err := mergeBatchResults(fetchers, maxWorkers); err != nil {
+		t.Fatalf("mergeBatchResults() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got > maxWorkers {
+		t.Errorf("mergeBatchResults() ran %d fetchers concurrently, want at most %d", got, maxWorkers)
+	}
+}
+
+func TestMergeBatchResultsPropagatesError(t *testing.T) {
+	wantErr := apierr.NewInternalError(fmt.Errorf("batch 1 failed"))
+	var inFlight, maxInFlight int32
+	fetchers := []func() (map[string]resource.Quantity, error){
+		fakeBatchFetcher(map[string]resource.Quantity{"a": resource.MustParse("1")}, nil, &inFlight, &maxInFlight, nil),
+		fakeBatchFetcher(nil, wantErr, &inFlight, &maxInFlight, nil),
+		fakeBatchFetcher(map[string]resource.Quantity{"b": resource.MustParse("2")}, nil, &inFlight, &maxInFlight, nil),
+	}
+	_, err := mergeBatchResults(fetchers, listTimeSeriesWorkers)
+	if err != wantErr {
+		t.Errorf("mergeBatchResults() error = %v, want %v", err, wantErr)
+	}
+}
+
+func TestMergeBatchResultsMergesAcrossBatches(t *testing.T) {
+	var inFlight, maxInFlight int32
+	fetchers := []func() (map[string]resource.Quantity, error){
+		fakeBatchFetcher(map[string]resource.Quantity{"a": resource.MustParse("1"), "shared": resource.MustParse("1")}, nil, &inFlight, &maxInFlight, nil),
+		fakeBatchFetcher(map[string]resource.Quantity{"b": resource.MustParse("2"), "shared": resource.MustParse("2")}, nil, &inFlight, &maxInFlight, nil),
+	}
+	got, err := mergeBatchResults(fetchers, listTimeSeriesWorkers)
+	if err != nil {
+		t.Fatalf("mergeBatchResults() error = %v", err)
+	}
+	want := map[string]resource.Quantity{
+		"a":      resource.MustParse("1"),
+		"b":      resource.MustParse("2"),
+		"shared": resource.MustParse("2"), // the later batch's value for a shared key wins.
+	}
+	if len(got) != len(want) {
+		t.Fatalf("mergeBatchResults() = %v, want %v", got, want)
+	}
+	for name, wantValue := range want {
+		if gotValue, ok := got[name]; !ok || gotValue.Cmp(wantValue) != 0 {
+			t.Errorf("mergeBatchResults()[%q] = %v, want %v", name, gotValue, wantValue)
+		}
+	}
+}
+
+func TestFilterForObjects(t *testing.T) {
+	tests := []struct {
+		name      string
+		mapping   ResourceTypeMapping
+		objNames  []string
+		namespace string
+		want      string
+	}{
+		{
+			name:      "namespaced, single name",
+			mapping:   ResourceTypeMapping{NameLabel: "service_name", NamespaceLabel: "namespace_name"},
+			objNames:  []string{`"frontend"`},
+			namespace: "default",
+			want:      `resource.label.namespace_name = "default" AND resource.label.service_name = "frontend"`,
+		},
+		{
+			name:      "namespaced, multiple names become one_of",
+			mapping:   ResourceTypeMapping{NameLabel: "service_name", NamespaceLabel: "namespace_name"},
+			objNames:  []string{`"frontend"`, `"backend"`},
+			namespace: "default",
+			want:      `resource.label.namespace_name = "default" AND resource.label.service_name = one_of("frontend","backend")`,
+		},
+		{
+			name:     "cluster-scoped, single name",
+			mapping:  ResourceTypeMapping{NameLabel: "volume_name"},
+			objNames: []string{`"vol-1"`},
+			want:     `resource.label.volume_name = "vol-1"`,
+		},
+		{
+			name:     "cluster-scoped, multiple names become one_of",
+			mapping:  ResourceTypeMapping{NameLabel: "volume_name"},
+			objNames: []string{`"vol-1"`, `"vol-2"`},
+			want:     `resource.label.volume_name = one_of("vol-1","vol-2")`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.mapping.filterForObjects(tt.objNames, tt.namespace); got != tt.want {
+				t.Errorf("filterForObjects() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSDReqForObjects(t *testing.T) {
+	serviceGR := schema.GroupResource{Group: "", Resource: "services"}
+
+	t.Run("no objects matched", func(t *testing.T) {
+		tr := &Translator{}
+		_, _, err := tr.GetSDReqForObjects(nil, serviceGR, "some_metric", "default", nil, "")
+		if err == nil {
+			t.Fatal("GetSDReqForObjects() error = nil, want an error for an empty object list")
+		}
+	})
+
+	t.Run("more objects than oneOfMax", func(t *testing.T) {
+		tr := &Translator{resourceTypeMappings: []ResourceTypeMapping{
+			{GroupResource: serviceGR, StackdriverResourceType: "k8s_service", NameLabel: "service_name", NamespaceLabel: "namespace_name"},
+		}}
+		objs := make([]metav1.ObjectMeta, oneOfMax+1)
+		_, _, err := tr.GetSDReqForObjects(objs, serviceGR, "some_metric", "default", nil, "")
+		if err == nil {
+			t.Fatal("GetSDReqForObjects() error = nil, want an error for more than oneOfMax objects")
+		}
+	})
+
+	t.Run("no ResourceTypeMapping registered for the GroupResource", func(t *testing.T) {
+		tr := &Translator{}
+		objs := []metav1.ObjectMeta{{Name: "frontend"}}
+		_, _, err := tr.GetSDReqForObjects(objs, serviceGR, "some_metric", "default", nil, "")
+		if err == nil {
+			t.Fatal("GetSDReqForObjects() error = nil, want an error for an unregistered GroupResource")
+		}
+	})
+}
+
+func TestGroupResourceForDescriptor(t *testing.T) {
+	serviceGR := schema.GroupResource{Group: "", Resource: "services"}
+	widgetGR := schema.GroupResource{Group: "example.com", Resource: "widgets"}
+
+	t.Run("no registered mapping matches", func(t *testing.T) {
+		tr := &Translator{}
+		got := tr.groupResourceForDescriptor(&stackdriver.MetricDescriptor{
+			Labels: []*stackdriver.LabelDescriptor{{Key: "verb"}},
+		})
+		want := schema.GroupResource{Group: "", Resource: "*"}
+		if got != want {
+			t.Errorf("groupResourceForDescriptor() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("single mapping matches", func(t *testing.T) {
+		tr := &Translator{resourceTypeMappings: []ResourceTypeMapping{
+			{GroupResource: serviceGR, MetricLabelKeys: []string{"service_name"}},
+		}}
+		got := tr.groupResourceForDescriptor(&stackdriver.MetricDescriptor{
+			Labels: []*stackdriver.LabelDescriptor{{Key: "service_name"}, {Key: "verb"}},
+		})
+		if got != serviceGR {
+			t.Errorf("groupResourceForDescriptor() = %v, want %v", got, serviceGR)
+		}
+	})
+
+	t.Run("overlapping MetricLabelKeys: first-registered mapping wins", func(t *testing.T) {
+		tr := &Translator{resourceTypeMappings: []ResourceTypeMapping{
+			{GroupResource: serviceGR, MetricLabelKeys: []string{"service_name"}},
+			{GroupResource: widgetGR, MetricLabelKeys: []string{"service_name"}},
+		}}
+		got := tr.groupResourceForDescriptor(&stackdriver.MetricDescriptor{
+			Labels: []*stackdriver.LabelDescriptor{{Key: "service_name"}},
+		})
+		if got != serviceGR {
+			t.Errorf("groupResourceForDescriptor() = %v, want the first-registered mapping %v", got, serviceGR)
+		}
+	})
+}